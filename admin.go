@@ -0,0 +1,42 @@
+// Admin identity for privileged chat commands. BanList introduced the
+// "admin !ban" command without ever defining who counts as an admin, which
+// let any logged-in user ban (and thereby evict) anyone else, including
+// other operators.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// AdminSet is the set of userids allowed to run admin-only slash/bang
+// commands, loaded once from a JSON file of userids (e.g. ["alice","bob"]).
+type AdminSet struct {
+	userids map[string]bool
+}
+
+// NewAdminSet loads the admin list from path, or starts empty (nobody is an
+// admin) if the file doesn't exist.
+func NewAdminSet(path string) *AdminSet {
+	as := &AdminSet{userids: map[string]bool{}}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return as
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		log.Print("AdminSet: unable to parse ", path, ": ", err)
+		return as
+	}
+	for _, id := range ids {
+		as.userids[id] = true
+	}
+	return as
+}
+
+// IsAdmin reports whether userid is allowed to run admin commands.
+func (as *AdminSet) IsAdmin(userid string) bool {
+	return as.userids[userid]
+}
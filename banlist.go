@@ -0,0 +1,107 @@
+// Ban list used by the Auth subsystem to keep flooders and abusive users off
+// the server. Bans are keyed by IP, username, or SSH key fingerprint and are
+// persisted to disk as JSON so they survive a server restart.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// BanKind identifies what a BanEntry's Value refers to.
+type BanKind string
+
+const (
+	BanIP   BanKind = "ip"
+	BanName BanKind = "name"
+	BanKey  BanKind = "key"
+)
+
+// BanEntry records a single ban and when it expires.
+type BanEntry struct {
+	Kind  BanKind   `json:"kind"`
+	Value string    `json:"value"`
+	Until time.Time `json:"until"`
+}
+
+// BanList tracks active bans and persists them to path as JSON.
+type BanList struct {
+	mu   sync.Mutex
+	path string
+	bans map[BanKind]map[string]time.Time
+}
+
+// NewBanList loads an existing ban list from path, or starts empty if the
+// file doesn't exist yet.
+func NewBanList(path string) *BanList {
+	bl := &BanList{
+		path: path,
+		bans: map[BanKind]map[string]time.Time{
+			BanIP:   {},
+			BanName: {},
+			BanKey:  {},
+		},
+	}
+	bl.load()
+	return bl
+}
+
+func (bl *BanList) load() {
+	data, err := os.ReadFile(bl.path)
+	if err != nil {
+		return
+	}
+	var entries []BanEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Print("BanList: unable to parse ", bl.path, ": ", err)
+		return
+	}
+	for _, e := range entries {
+		bl.bans[e.Kind][e.Value] = e.Until
+	}
+}
+
+// save rewrites the ban list to disk. Callers must hold bl.mu.
+func (bl *BanList) save() {
+	var entries []BanEntry
+	for kind, values := range bl.bans {
+		for value, until := range values {
+			entries = append(entries, BanEntry{Kind: kind, Value: value, Until: until})
+		}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		log.Print("BanList: marshal failed ", err)
+		return
+	}
+	if err := os.WriteFile(bl.path, data, 0600); err != nil {
+		log.Print("BanList: write failed ", err)
+	}
+}
+
+// Ban bans value (of the given kind) for duration, persisting the change.
+func (bl *BanList) Ban(kind BanKind, value string, duration time.Duration) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.bans[kind][value] = time.Now().Add(duration)
+	bl.save()
+}
+
+// IsBanned reports whether value (of the given kind) is currently banned,
+// clearing the entry if it has expired.
+func (bl *BanList) IsBanned(kind BanKind, value string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	until, ok := bl.bans[kind][value]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(bl.bans[kind], value)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanListBanAndIsBanned(t *testing.T) {
+	bl := NewBanList(filepath.Join(t.TempDir(), "bans.json"))
+
+	if bl.IsBanned(BanName, "alice") {
+		t.Fatal("alice should not be banned yet")
+	}
+
+	bl.Ban(BanName, "alice", time.Hour)
+	if !bl.IsBanned(BanName, "alice") {
+		t.Fatal("expected alice to be banned")
+	}
+	if bl.IsBanned(BanName, "bob") {
+		t.Fatal("banning alice should not affect bob")
+	}
+}
+
+func TestBanListExpiry(t *testing.T) {
+	bl := NewBanList(filepath.Join(t.TempDir(), "bans.json"))
+
+	bl.Ban(BanIP, "127.0.0.1", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if bl.IsBanned(BanIP, "127.0.0.1") {
+		t.Fatal("expected the ban to have expired")
+	}
+}
+
+func TestBanListPersistsAcrossLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+
+	bl := NewBanList(path)
+	bl.Ban(BanKey, "SHA256:abc", time.Hour)
+
+	reloaded := NewBanList(path)
+	if !reloaded.IsBanned(BanKey, "SHA256:abc") {
+		t.Fatal("expected the ban to survive reloading from disk")
+	}
+}
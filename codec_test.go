@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	packet := Packet{Action: "MSG", Userid: "alice", Data: "hello", Codec: CodecJSON}
+
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := codec.Encode(&buf, packet, nil); err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			got, err := codec.Decode(&buf, nil)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if got != packet {
+				t.Fatalf("Decode = %+v, want %+v", got, packet)
+			}
+		})
+	}
+}
+
+func TestCodecRoundTripWithSession(t *testing.T) {
+	packet := Packet{Action: "MSG", Userid: "alice", Data: "hello"}
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	codec := jsonCodec{}
+
+	var buf bytes.Buffer
+	send := &Session{Key: key}
+	if err := codec.Encode(&buf, packet, send); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	recv := &Session{Key: key}
+	got, err := codec.Decode(&buf, recv)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if got != packet {
+		t.Fatalf("Decode = %+v, want %+v", got, packet)
+	}
+}
+
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	var header [4]byte
+	binary := uint32(maxFrameSize + 1)
+	header[0] = byte(binary >> 24)
+	header[1] = byte(binary >> 16)
+	header[2] = byte(binary >> 8)
+	header[3] = byte(binary)
+
+	r := bytes.NewReader(header[:])
+	if _, err := readFrame(r, nil); err == nil {
+		t.Fatal("expected readFrame to reject a frame larger than maxFrameSize")
+	}
+}
+
+func TestUnmacFrameRejectsReplay(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	send := &Session{Key: key}
+
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, []byte("payload"), send); err != nil {
+		t.Fatalf("writeFrame failed: %v", err)
+	}
+	frame := buf.Bytes()
+
+	recv := &Session{Key: key}
+	if _, err := readFrame(bytes.NewReader(frame), recv); err != nil {
+		t.Fatalf("first read should succeed: %v", err)
+	}
+	if _, err := readFrame(bytes.NewReader(frame), recv); err == nil {
+		t.Fatal("expected a replayed frame to be rejected")
+	}
+}
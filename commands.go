@@ -0,0 +1,194 @@
+// Slash-command protocol for the chat server. Any client MSG whose data
+// begins with "/" is parsed here into a Command and handed to the
+// broadcaster goroutine, which is the sole owner of the clients/rooms maps.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Room groups the clients that receive each other's broadcasts, keyed by
+// userid within the room.
+type Room map[string]Instance
+
+// defaultRoom is where every client lands on LOGIN.
+const defaultRoom = "general"
+
+// rooms holds every room by name. Only the broadcaster goroutine may read
+// or write it.
+var rooms = map[string]Room{defaultRoom: {}}
+
+// CommandKind identifies a parsed slash command.
+type CommandKind string
+
+const (
+	CmdWho   CommandKind = "who"
+	CmdNick  CommandKind = "nick"
+	CmdMsg   CommandKind = "msg"
+	CmdJoin  CommandKind = "join"
+	CmdLeave CommandKind = "leave"
+	CmdKick  CommandKind = "kick"
+)
+
+// Command is a parsed slash command awaiting execution by the broadcaster.
+// Reply is only set (and must be read back) for commands that change the
+// sender's own identity or room, so handleConn can keep its local state in
+// sync with the authoritative copy in clients/rooms.
+type Command struct {
+	Kind   CommandKind
+	Userid string
+	Room   string
+	Args   []string
+	Reply  chan string
+}
+
+var commands = make(chan Command, 10)
+
+// parseCommand turns slash-command text into a Command. ok is false if text
+// isn't a recognized command.
+func parseCommand(userid, room, text string) (Command, bool) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return Command{}, false
+	}
+
+	cmd := Command{Userid: userid, Room: room}
+
+	switch fields[0] {
+	case "/who":
+		cmd.Kind = CmdWho
+	case "/nick":
+		if len(fields) != 2 {
+			return Command{}, false
+		}
+		cmd.Kind = CmdNick
+		cmd.Args = fields[1:2]
+	case "/msg":
+		if len(fields) < 3 {
+			return Command{}, false
+		}
+		cmd.Kind = CmdMsg
+		cmd.Args = []string{fields[1], strings.Join(fields[2:], " ")}
+	case "/join":
+		if len(fields) != 2 {
+			return Command{}, false
+		}
+		cmd.Kind = CmdJoin
+		cmd.Args = fields[1:2]
+	case "/leave":
+		cmd.Kind = CmdLeave
+	case "/kick":
+		if len(fields) != 2 {
+			return Command{}, false
+		}
+		cmd.Kind = CmdKick
+		cmd.Args = fields[1:2]
+	default:
+		return Command{}, false
+	}
+
+	return cmd, true
+}
+
+// reply delivers a private server line to userid without going through the
+// room broadcast fan-out. It goes through deliverQueue rather than
+// instance.Channel directly: reply is called from the broadcaster
+// goroutine itself (via executeCommand/handleBanCommand), so a raw
+// blocking send to a full client channel would freeze broadcasting,
+// entering, leaving, and commands for every other client too.
+func reply(userid, text string) {
+	if instance, ok := clients[userid]; ok {
+		deliverQueue <- deliverJob{Instance: instance, Message: Message{Userid: "server", Data: text}}
+	}
+}
+
+// executeCommand runs a parsed command. It must only be called from the
+// broadcaster goroutine, since it reads and writes clients/rooms directly.
+func executeCommand(cmd Command) {
+	switch cmd.Kind {
+
+	case CmdWho:
+		var names []string
+		for name := range rooms[cmd.Room] {
+			names = append(names, name)
+		}
+		reply(cmd.Userid, fmt.Sprintf("users in %s: %s", cmd.Room, strings.Join(names, ", ")))
+
+	case CmdNick:
+		cmd.Reply <- renameClient(cmd.Userid, cmd.Args[0])
+
+	case CmdMsg:
+		target, text := cmd.Args[0], cmd.Args[1]
+		if _, ok := clients[target]; !ok {
+			reply(cmd.Userid, fmt.Sprintf("no such user %s", target))
+			return
+		}
+		reply(target, fmt.Sprintf("(whisper) %s: %s", cmd.Userid, text))
+		reply(cmd.Userid, fmt.Sprintf("(whisper to %s) %s", target, text))
+
+	case CmdJoin:
+		cmd.Reply <- moveRoom(cmd.Userid, cmd.Args[0])
+
+	case CmdLeave:
+		cmd.Reply <- moveRoom(cmd.Userid, defaultRoom)
+
+	case CmdKick:
+		target := cmd.Args[0]
+		if instance, ok := clients[target]; ok {
+			reply(target, "you have been kicked")
+			instance.Connect.Close()
+		} else {
+			reply(cmd.Userid, fmt.Sprintf("no such user %s", target))
+		}
+	}
+}
+
+// renameClient moves userid's registration to newid in both clients and its
+// current room, returning the userid that ends up in effect.
+func renameClient(userid, newid string) string {
+	instance, ok := clients[userid]
+	if !ok {
+		return userid
+	}
+	if _, taken := clients[newid]; taken {
+		reply(userid, fmt.Sprintf("nick %s is already taken", newid))
+		return userid
+	}
+	if banList.IsBanned(BanName, newid) {
+		reply(userid, fmt.Sprintf("nick %s is banned", newid))
+		return userid
+	}
+
+	delete(clients, userid)
+	delete(rooms[instance.Room], userid)
+
+	instance.Userid = newid
+	clients[newid] = instance
+	rooms[instance.Room][newid] = instance
+
+	reply(newid, fmt.Sprintf("you are now known as %s", newid))
+	return newid
+}
+
+// moveRoom removes userid from its current room and adds it to newRoom,
+// creating newRoom if this is the first client to join it. It returns the
+// room the client ends up in.
+func moveRoom(userid, newRoom string) string {
+	instance, ok := clients[userid]
+	if !ok {
+		return defaultRoom
+	}
+
+	delete(rooms[instance.Room], userid)
+
+	if rooms[newRoom] == nil {
+		rooms[newRoom] = Room{}
+	}
+	instance.Room = newRoom
+	clients[userid] = instance
+	rooms[newRoom][userid] = instance
+
+	reply(userid, fmt.Sprintf("joined room %s", newRoom))
+	return newRoom
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		wantOk  bool
+		wantCmd CommandKind
+		wantArg []string
+	}{
+		{"who", "/who", true, CmdWho, nil},
+		{"nick", "/nick bob", true, CmdNick, []string{"bob"}},
+		{"nick missing arg", "/nick", false, "", nil},
+		{"nick extra arg", "/nick bob smith", false, "", nil},
+		{"msg", "/msg bob hi there", true, CmdMsg, []string{"bob", "hi there"}},
+		{"msg missing text", "/msg bob", false, "", nil},
+		{"join", "/join lobby", true, CmdJoin, []string{"lobby"}},
+		{"leave", "/leave", true, CmdLeave, nil},
+		{"kick", "/kick bob", true, CmdKick, []string{"bob"}},
+		{"unknown", "/nope", false, "", nil},
+		{"empty", "", false, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, ok := parseCommand("alice", defaultRoom, tt.text)
+			if ok != tt.wantOk {
+				t.Fatalf("parseCommand(%q) ok = %v, want %v", tt.text, ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if cmd.Kind != tt.wantCmd {
+				t.Errorf("parseCommand(%q) kind = %v, want %v", tt.text, cmd.Kind, tt.wantCmd)
+			}
+			if len(cmd.Args) != len(tt.wantArg) {
+				t.Fatalf("parseCommand(%q) args = %v, want %v", tt.text, cmd.Args, tt.wantArg)
+			}
+			for i := range tt.wantArg {
+				if cmd.Args[i] != tt.wantArg[i] {
+					t.Errorf("parseCommand(%q) args[%d] = %q, want %q", tt.text, i, cmd.Args[i], tt.wantArg[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRenameClient(t *testing.T) {
+	defer func(saved map[string]Instance) { clients = saved }(clients)
+	defer func(saved map[string]Room) { rooms = saved }(rooms)
+	clients = map[string]Instance{}
+	rooms = map[string]Room{defaultRoom: {}}
+
+	alice := Instance{Userid: "alice", Room: defaultRoom, Channel: make(chan Message, 1)}
+	clients["alice"] = alice
+	rooms[defaultRoom]["alice"] = alice
+
+	got := renameClient("alice", "alicia")
+	if got != "alicia" {
+		t.Fatalf("renameClient returned %q, want %q", got, "alicia")
+	}
+	if _, ok := clients["alice"]; ok {
+		t.Error("old userid should no longer be registered")
+	}
+	if _, ok := clients["alicia"]; !ok {
+		t.Error("new userid should be registered")
+	}
+	if _, ok := rooms[defaultRoom]["alicia"]; !ok {
+		t.Error("new userid should be registered in its room")
+	}
+}
+
+// TestReplyDoesNotBlockOnFullChannel guards against reply() regressing back
+// to a raw instance.Channel send: since reply runs on the broadcaster
+// goroutine (via executeCommand/handleBanCommand), a full target channel
+// must not stall the caller.
+func TestReplyDoesNotBlockOnFullChannel(t *testing.T) {
+	defer func(saved map[string]Instance) { clients = saved }(clients)
+	clients = map[string]Instance{}
+
+	// deliverWorker evicts a slow consumer by closing its Connect, so this
+	// needs a real net.Conn rather than a nil one.
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	full := make(chan Message, 1)
+	full <- Message{} // fill it so a direct send would block
+	clients["alice"] = Instance{Userid: "alice", Channel: full, Connect: conn}
+
+	done := make(chan struct{})
+	go func() {
+		reply("alice", "hi")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(300 * time.Millisecond):
+		t.Fatal("reply blocked on a full client channel instead of going through deliverQueue")
+	}
+}
+
+func TestRenameClientRejectsTakenNick(t *testing.T) {
+	defer func(saved map[string]Instance) { clients = saved }(clients)
+	defer func(saved map[string]Room) { rooms = saved }(rooms)
+	clients = map[string]Instance{}
+	rooms = map[string]Room{defaultRoom: {}}
+
+	alice := Instance{Userid: "alice", Room: defaultRoom, Channel: make(chan Message, 1)}
+	bob := Instance{Userid: "bob", Room: defaultRoom, Channel: make(chan Message, 1)}
+	clients["alice"], clients["bob"] = alice, bob
+	rooms[defaultRoom]["alice"], rooms[defaultRoom]["bob"] = alice, bob
+
+	got := renameClient("alice", "bob")
+	if got != "alice" {
+		t.Fatalf("renameClient returned %q, want unchanged %q", got, "alice")
+	}
+	if _, ok := clients["alice"]; !ok {
+		t.Error("alice should still be registered under her old nick")
+	}
+}
+
+// TestRenameClientRejectsBannedNick guards against /nick letting a user
+// rename into a name banned by BanName without consulting banList, the same
+// check handleConn/authorizeKey already apply at connection time.
+func TestRenameClientRejectsBannedNick(t *testing.T) {
+	defer func(saved map[string]Instance) { clients = saved }(clients)
+	defer func(saved map[string]Room) { rooms = saved }(rooms)
+	defer func(saved *BanList) { banList = saved }(banList)
+	clients = map[string]Instance{}
+	rooms = map[string]Room{defaultRoom: {}}
+	banList = NewBanList(filepath.Join(t.TempDir(), "bans.json"))
+	banList.Ban(BanName, "mallory", time.Hour)
+
+	alice := Instance{Userid: "alice", Room: defaultRoom, Channel: make(chan Message, 1)}
+	clients["alice"] = alice
+	rooms[defaultRoom]["alice"] = alice
+
+	got := renameClient("alice", "mallory")
+	if got != "alice" {
+		t.Fatalf("renameClient returned %q, want unchanged %q", got, "alice")
+	}
+	if _, ok := clients["alice"]; !ok {
+		t.Error("alice should still be registered under her old nick")
+	}
+	if _, ok := clients["mallory"]; ok {
+		t.Error("banned nick should not have been granted")
+	}
+}
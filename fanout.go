@@ -0,0 +1,54 @@
+// Parallel message fan-out with slow-consumer eviction. Delivering to each
+// client directly from the broadcaster's select loop meant one slow reader
+// could block every other client's messages; a worker pool delivers to
+// clients concurrently instead, and gives up on (and evicts) whichever
+// client hasn't drained its queue within sendDeadline.
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// sendDeadline bounds how long a fan-out worker waits for room in a
+// client's outbound queue before treating it as a slow consumer, mirroring
+// the "TCP buffer fills, drop the client" pattern from gopl.io's chat
+// example.
+const sendDeadline = 200 * time.Millisecond
+
+// clientQueueSize is each client's outbound channel capacity: its
+// high-water mark before it's considered a slow consumer.
+const clientQueueSize = 32
+
+// fanoutWorkers is how many goroutines deliver broadcast messages to
+// clients concurrently.
+const fanoutWorkers = 8
+
+// deliverJob is one (client, message) delivery waiting to run in the
+// fan-out worker pool.
+type deliverJob struct {
+	Instance Instance
+	Message  Message
+}
+
+var deliverQueue = make(chan deliverJob, 256)
+
+func init() {
+	for i := 0; i < fanoutWorkers; i++ {
+		go deliverWorker()
+	}
+}
+
+// deliverWorker sends queued messages to their target client, evicting slow
+// consumers instead of blocking behind them.
+func deliverWorker() {
+	for job := range deliverQueue {
+		select {
+		case job.Instance.Channel <- job.Message:
+		case <-time.After(sendDeadline):
+			log.Printf("client %s is a slow consumer, evicting", job.Instance.Userid)
+			job.Instance.Connect.Close()
+			leaving <- job.Instance
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Pre-LOGIN key exchange. TLS already encrypts the transport, but when it's
+// terminated at a proxy in front of us that protection ends there; this
+// handshake derives a session key straight from the two endpoints so each
+// Packet can still be MACed end-to-end against tampering or replay.
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+)
+
+// channelBindingLabel and channelBindingLen parameterize the RFC 5705
+// keying material sessionHandshake exports from the TLS connection and
+// mixes into the derived key. Without this, a proxy terminating our TLS is,
+// by construction, on-path for the raw X25519 exchange too: it could run
+// two independent sessions (client<->proxy, proxy<->server) and relay or
+// tamper between them, defeating the MAC/replay protection for exactly the
+// threat this handshake exists to cover. Binding to the connection's TLS
+// session means each leg of such a proxy derives a different key, so
+// re-terminating TLS is no longer transparent.
+const (
+	channelBindingLabel = "go-chat-test session binding"
+	channelBindingLen   = 32
+)
+
+// counterSize is the width of the monotonic counter macFrame mixes into
+// every frame.
+const counterSize = 8
+
+// Session is the state a connection keeps after sessionHandshake: the
+// shared MAC key plus independent monotonic counters for each direction.
+// Encode only ever advances sendSeq and Decode only ever advances recvSeq,
+// so each is safe to use from its own single goroutine without locking.
+type Session struct {
+	Key     []byte
+	sendSeq uint64
+	recvSeq uint64
+}
+
+// sessionHandshake performs an ephemeral X25519 key exchange over conn and
+// returns a fresh Session built from the derived key, bound to conn's TLS
+// session via exported keying material. conn must have completed (or be
+// ready to complete) its TLS handshake; a *tls.Conn straight from Dial or
+// Accept works either way since sessionHandshake forces Handshake itself.
+func sessionHandshake(conn *tls.Conn) (*Session, error) {
+	if err := conn.Handshake(); err != nil {
+		return nil, fmt.Errorf("sessionHandshake: TLS handshake: %w", err)
+	}
+
+	curve := ecdh.X25519()
+	priv, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFrame(conn, priv.PublicKey().Bytes(), nil); err != nil {
+		return nil, err
+	}
+	peerBytes, err := readFrame(conn, nil)
+	if err != nil {
+		return nil, err
+	}
+	peerKey, err := curve.NewPublicKey(peerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("sessionHandshake: bad peer key: %w", err)
+	}
+
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	state := conn.ConnectionState()
+	binding, err := state.ExportKeyingMaterial(channelBindingLabel, nil, channelBindingLen)
+	if err != nil {
+		return nil, fmt.Errorf("sessionHandshake: export keying material: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, shared)
+	mac.Write(binding)
+	return &Session{Key: mac.Sum(nil)}, nil
+}
+
+// macFrame returns payload prefixed with a monotonically increasing
+// counter and an HMAC-SHA256 over (counter || payload), keyed by
+// session.Key. The counter is what turns this from tamper-detection into
+// replay-detection: unmacFrame rejects a frame whose counter isn't after
+// the last one it accepted, so a captured frame replayed verbatim later in
+// the session no longer verifies.
+func macFrame(session *Session, payload []byte) []byte {
+	session.sendSeq++
+	var ctr [counterSize]byte
+	binary.BigEndian.PutUint64(ctr[:], session.sendSeq)
+
+	mac := hmac.New(sha256.New, session.Key)
+	mac.Write(ctr[:])
+	mac.Write(payload)
+
+	out := make([]byte, 0, counterSize+sha256.Size+len(payload))
+	out = append(out, ctr[:]...)
+	out = append(out, mac.Sum(nil)...)
+	out = append(out, payload...)
+	return out
+}
+
+// unmacFrame splits a frame produced by macFrame back into its payload,
+// verifying the MAC and that its counter is newer than the last one seen
+// on this session before accepting it.
+func unmacFrame(session *Session, frame []byte) ([]byte, error) {
+	if len(frame) < counterSize+sha256.Size {
+		return nil, fmt.Errorf("unmacFrame: frame too short to contain a counter and MAC")
+	}
+	ctrBytes := frame[:counterSize]
+	tag := frame[counterSize : counterSize+sha256.Size]
+	payload := frame[counterSize+sha256.Size:]
+
+	mac := hmac.New(sha256.New, session.Key)
+	mac.Write(ctrBytes)
+	mac.Write(payload)
+	if !hmac.Equal(tag, mac.Sum(nil)) {
+		return nil, fmt.Errorf("unmacFrame: packet MAC mismatch, tampered or replayed")
+	}
+
+	counter := binary.BigEndian.Uint64(ctrBytes)
+	if counter <= session.recvSeq {
+		return nil, fmt.Errorf("unmacFrame: frame counter %d is not after last seen %d, rejecting as a replay", counter, session.recvSeq)
+	}
+	session.recvSeq = counter
+	return payload, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// selfSignedTLSConfig builds a throwaway self-signed cert/key pair so tests
+// can stand up a real *tls.Conn without touching disk.
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}}}
+}
+
+// TestSessionHandshakeAgreesAcrossTLSConnection runs sessionHandshake over a
+// real TCP+TLS connection on both ends and checks they derive the identical
+// key. sessionHandshake mixes in keying material exported from the TLS
+// connection so a proxy that terminates and re-originates TLS can't
+// transparently relay the X25519 exchange between two independent legs;
+// this only guards anything if both legitimate peers still agree on the
+// same key over their shared, unterminated connection. A real listener is
+// used rather than net.Pipe because sessionHandshake writes its own public
+// key before reading the peer's on both ends, which net.Pipe's unbuffered
+// rendezvous can't satisfy concurrently.
+func TestSessionHandshakeAgreesAcrossTLSConnection(t *testing.T) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", selfSignedTLSConfig(t))
+	if err != nil {
+		t.Fatalf("tls.Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	serverDone := make(chan *Session, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("Accept failed: %v", err)
+			serverDone <- nil
+			return
+		}
+		session, err := sessionHandshake(conn.(*tls.Conn))
+		if err != nil {
+			t.Errorf("server sessionHandshake failed: %v", err)
+			serverDone <- nil
+			return
+		}
+		serverDone <- session
+	}()
+
+	client, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial failed: %v", err)
+	}
+	clientSession, err := sessionHandshake(client)
+	if err != nil {
+		t.Fatalf("client sessionHandshake failed: %v", err)
+	}
+	serverSession := <-serverDone
+	if serverSession == nil {
+		t.Fatal("server session handshake failed, see above")
+	}
+
+	if len(clientSession.Key) == 0 {
+		t.Fatal("sessionHandshake produced an empty key")
+	}
+	if string(clientSession.Key) != string(serverSession.Key) {
+		t.Fatal("client and server derived different session keys over the same TLS connection")
+	}
+}
@@ -3,12 +3,15 @@ package main
 
 import (
 	"os"
-	"fmt"
 	"log"
 	"bufio"
 	"net"
-	"encoding/json"
-	"io"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -19,7 +22,7 @@ var (
 //
 func main() {
 
-	if len(os.Args) != 2  {
+	if len(os.Args) < 2 || len(os.Args) > 4 {
 		log.Fatal("userid or runserver should be first argument")
 	}
 
@@ -29,10 +32,65 @@ func main() {
 		return
 	}
 
+	// Check if we want to start the SSH-authenticated server instead
+	if ( os.Args[1] == "runsshserver" ) {
+		StartSSHServer("localhost:2022", "ssh_host_key")
+		return
+	}
+
+	// Check if we want to start the TLS-wrapped server instead
+	if ( os.Args[1] == "runtlsserver" ) {
+		StartTLSServer("localhost:8443", ServerConfig{CertFile: "server.crt", KeyFile: "server.key"})
+		return
+	}
+
 	userid := os.Args[1]
-	// Create a channel for sending Packet structures between inputHandler and main
-	inputChannel := make(chan Packet)
-	connect, err := net.Dial("tcp", "localhost:8000")
+
+	// Pick the wire codec for this session; defaults to JSON if not given.
+	codecName := CodecJSON
+	if len(os.Args) >= 3 {
+		codecName = os.Args[2]
+	}
+	codec, ok := codecs[codecName]
+	if !ok {
+		log.Fatalf("unknown codec %s", codecName)
+	}
+
+	// A fourth argument picks the transport: "tls" connects to the
+	// TLS-wrapped server and performs the X25519 handshake afterwards so
+	// every packet is MACed end-to-end; "ssh" connects to the
+	// SSH-authenticated server instead, where identity comes from the
+	// client's key rather than a LOGIN packet.
+	transport := ""
+	if len(os.Args) == 4 {
+		transport = os.Args[3]
+	}
+
+	if transport == "ssh" {
+		if codecName != CodecJSON {
+			log.Fatal("ssh transport only supports the json codec: it has no LOGIN packet to negotiate one over")
+		}
+		runSSHClient(userid, codec)
+		return
+	}
+
+	useTLS := transport == "tls"
+
+	var connect net.Conn
+	var tlsConn *tls.Conn
+	var err error
+	var session *Session
+
+	if useTLS {
+		tlsConfig, cfgErr := ClientConfig{ServerName: "localhost", RootCAs: []string{"ca.crt"}}.tlsConfig()
+		if cfgErr != nil {
+			log.Fatal(cfgErr)
+		}
+		tlsConn, err = tls.Dial("tcp", "localhost:8443", tlsConfig)
+		connect = tlsConn
+	} else {
+		connect, err = net.Dial("tcp", "localhost:8000")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -42,14 +100,26 @@ func main() {
 	// Create the ReadWriter for talking to the server
 	rw := bufio.NewReadWriter(bufio.NewReader(connect), bufio.NewWriter(connect))
 
-	// Make a longin packet  and send to the server
+	if useTLS {
+		session, err = sessionHandshake(tlsConn)
+		if err != nil {
+			log.Fatal("session handshake failed: ", err)
+		}
+	}
+
+	// Create a channel for sending Packet structures between inputHandler and main
+	inputChannel := make(chan Packet)
+
+	// Make a login packet and send to the server. LOGIN is always sent with
+	// the JSON codec, naming the codec to use for everything after it.
 	packet := Packet{}
 	packet.Action = "LOGIN"
 	packet.Userid = userid
-	writePacketToServer(rw, packet)
+	packet.Codec = codecName
+	writePacketToServer(rw, packet, codecs[CodecJSON], session)
 
 	// start asynchronous receive messages
-	go receiveHandler(rw)
+	go receiveHandler(rw, codec, session)
 
 	// Get message input from a goroutine provided through a channel.
 	go inputHandler(userid, inputChannel)
@@ -57,18 +127,70 @@ func main() {
 	// Get input lines and send to server as a message packet.
 	for {
 		packet = <-inputChannel
-		writePacketToServer(rw, packet)
+		writePacketToServer(rw, packet, codec, session)
 		if packet.Action == "QUIT" {
 			break;
 		}
 	}
 }
 
+// runSSHClient connects to the SSH-authenticated server (runsshserver)
+// instead of the plaintext/TLS transports. The server derives identity
+// from the authenticated key rather than a LOGIN packet, so there is no
+// LOGIN to send: the client authenticates with an ephemeral key, opens a
+// "chat" channel (not "session", since nothing here speaks the pty/shell
+// requests a real interactive SSH client would send), and speaks the same
+// length-prefixed Packet protocol as the other transports directly over
+// that channel.
+func runSSHClient(userid string, codec Codec) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            userid,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	client, err := ssh.Dial("tcp", "localhost:2022", config)
+	if err != nil {
+		log.Fatal("ssh dial failed: ", err)
+	}
+
+	channel, requests, err := client.OpenChannel("chat", nil)
+	if err != nil {
+		log.Fatal("ssh open channel failed: ", err)
+	}
+	go ssh.DiscardRequests(requests)
+
+	log.Printf("Chat client has started for %s over ssh", userid)
+
+	rw := bufio.NewReadWriter(bufio.NewReader(channel), bufio.NewWriter(channel))
+
+	inputChannel := make(chan Packet)
+	go receiveHandler(rw, codec, nil)
+	go inputHandler(userid, inputChannel)
+
+	for {
+		packet := <-inputChannel
+		writePacketToServer(rw, packet, codec, nil)
+		if packet.Action == "QUIT" {
+			break
+		}
+	}
+}
+
 // Read the input lines and for each pass back a packet with
 // the proper action, userid, and text
 //
 func inputHandler(userid string, inputChannel chan Packet) {
-	log.Print("Input chat messages, Enter !q to quit")
+	log.Print("Input chat messages, Enter !q to quit, !history [n] to page back")
 	packet := Packet{}
 	packet.Userid = userid
 	scanner := bufio.NewScanner(os.Stdin)
@@ -76,53 +198,44 @@ func inputHandler(userid string, inputChannel chan Packet) {
 	for text != "!q" {  // break the loop if text == "!q"
 		scanner.Scan()
 		text = scanner.Text()
-		if text != "!q" {
+		if text == "!q" {
+			break
+		}
+		if strings.HasPrefix(text, "!history") {
+			packet.Action = "HISTORY"
+			packet.Data = strings.TrimSpace(strings.TrimPrefix(text, "!history"))
+		} else {
 			packet.Action = "MSG"
 			packet.Data = text
-			inputChannel <- packet
 		}
+		inputChannel <- packet
 	}
 	// end of loop, send back quit to terminate
 	packet.Action = "QUIT"
 	inputChannel <- packet
 }
 
-// Write a packet to chat server. The packet is converted into JSON and
-// then sent to  the server.
+// Write a packet to the chat server using the given codec, framed with a
+// length prefix.
 //
-func writePacketToServer(rw *bufio.ReadWriter, packet Packet)  {
+func writePacketToServer(rw *bufio.ReadWriter, packet Packet, codec Codec, session *Session)  {
 
-	stream, err := json.Marshal(packet)
-    if ( err != nil ) {
-    	log.Fatal("writePacketToServer marshal failed ", err)
+	if err := codec.Encode(rw, packet, session); err != nil {
+		log.Fatal("writePacketToServer encode failed ", err)
 	}
-	s := fmt.Sprintf("%s\n", stream)
-	_, err = rw.WriteString(s)
-	rw.Flush()
-	if err != nil {
+	if err := rw.Flush(); err != nil {
 		log.Fatal("writePacketToServer write failed ", err)
 	}
 }
 
-// Receive raw text messages from the server and echo to the console
+// Receive packets from the server and echo them to the console
 //
-func receiveHandler(rw *bufio.ReadWriter) {
+func receiveHandler(rw *bufio.ReadWriter, codec Codec, session *Session) {
 
 	for {
-		response, err := rw.ReadString('\n')
-		if err != nil  {
-			if _, err := rw.Peek(1); err == io.EOF {
-				log.Fatal("Chat server has unexpectedly disconnected")
-			}
-			log.Print(err)
-			continue
-		}
-
-		packet := Packet{}
-		err = json.Unmarshal([]byte(response), &packet)
+		packet, err := codec.Decode(rw, session)
 		if err != nil {
-			log.Printf("Unable to unmarshal package, err=%s", err)
-			log.Fatal("Client is terminating\n")
+			log.Fatal("Chat server has unexpectedly disconnected: ", err)
 		}
 		s := packet.Userid + " -> " + packet.Data
 		log.Print(s)
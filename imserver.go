@@ -4,11 +4,13 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 )
 
 // Packet : nput/Output packet structure for client(s)
@@ -16,6 +18,7 @@ type Packet struct {
 	Action string
 	Userid string
 	Data   string
+	Codec  string // wire codec to use from this point on; only meaningful on LOGIN
 }
 
 // Message : Output channel structure for a message
@@ -23,6 +26,7 @@ type Packet struct {
 type Message struct {
 	Userid string
 	Data   string
+	Room   string
 	Clinst Instance
 }
 
@@ -35,6 +39,13 @@ type Instance struct {
 	Channel client
 	Connect net.Conn
 	RW      *bufio.ReadWriter
+	Limiter *RateLimiter
+	Room    string
+	Codec   Codec
+	// Session is non-nil when this connection completed the X25519
+	// handshake (the TLS transport), and MACs/sequences every frame
+	// through it.
+	Session *Session
 }
 
 // Common channels and client list
@@ -51,6 +62,7 @@ var (
 func StartServer() {
 
 	log.Print("Chat server started")
+	initStore()
 	listener, err := net.Listen("tcp", "localhost:8000")
 	if err != nil {
 		log.Fatal(err)
@@ -66,46 +78,112 @@ func StartServer() {
 			log.Fatal(err)
 		}
 		// talk to the client from this goroutine
-		go handleConn(conn)
+		go handleConn(conn, nil)
+	}
+}
+
+// StartTLSServer starts a TLS-wrapped listener as an alternative to the
+// plaintext TCP transport. After the TLS handshake, each connection also
+// performs an X25519 key exchange so its Packets can be MACed even if TLS
+// is terminated at a proxy in front of us.
+func StartTLSServer(addr string, cfg ServerConfig) {
+
+	initStore()
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Print("TLS chat server started on ", addr)
+
+	go broadcaster()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		go func(conn net.Conn) {
+			tlsConn, ok := conn.(*tls.Conn)
+			if !ok {
+				log.Print("session handshake failed: not a TLS connection")
+				conn.Close()
+				return
+			}
+			session, err := sessionHandshake(tlsConn)
+			if err != nil {
+				log.Print("session handshake failed: ", err)
+				conn.Close()
+				return
+			}
+			handleConn(conn, session)
+		}(conn)
 	}
 }
 
 // Handle a client connection. Receive JSON packets, handle actions, dispatch
-// messages to broadcaster
+// messages to broadcaster. session is non-nil when the caller has already
+// completed the X25519 handshake (the TLS transport); it is nil for the
+// plaintext TCP transport.
 //
-func handleConn(conn net.Conn) {
+func handleConn(conn net.Conn, session *Session) {
 
 	var userid = "unknown"
 
 	log.Print("Handling connection from ", conn.RemoteAddr().String())
 
+	// The SSH transport checks banList in its PublicKeyCallback before a
+	// connection is even accepted; do the equivalent here so a banned IP
+	// can't just reconnect over plaintext or TLS instead.
+	ip := hostOnly(conn.RemoteAddr().String())
+	if banList.IsBanned(BanIP, ip) {
+		log.Printf("rejected connection from banned ip %s", ip)
+		conn.Close()
+		return
+	}
+
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 
 	// Initialize the client instance and message channel
 	instance := Instance{}
 	instance.Connect = conn
 	instance.RW = rw
-	ch := make(chan Message, 10)
+	instance.Limiter = NewRateLimiter(20, 5)
+	instance.Codec = codecs[CodecJSON]
+	instance.Session = session
+	ch := make(chan Message, clientQueueSize)
 	instance.Channel = ch
 
 	for {
-		// Read the next packet from this client
-		response, err := rw.ReadString('\n')
+		// Read the next packet from this client. Every connection starts out
+		// on the JSON codec; LOGIN may switch it to whatever instance.Codec
+		// negotiates below.
+		packet, err := instance.Codec.Decode(rw, instance.Session)
 		if err != nil {
-			log.Print(err)
-			if _, err := rw.Peek(1); err == io.EOF {
+			// Any decode failure, not just EOF, leaves the stream unable to
+			// resync (e.g. a rejected oversized frame still has unread
+			// payload bytes sitting in front of the next header), so treat
+			// every decode error as fatal to this connection.
+			if err == io.EOF {
 				log.Printf("User %s has unexpectedly disconnected %s", userid, err)
-				conn.Close()
-				return
+			} else {
+				log.Print(err)
 			}
-			continue
+			conn.Close()
+			return
 		}
 
-		packet := Packet{}
-		err = json.Unmarshal([]byte(response), &packet)
-		if err != nil {
-			log.Printf("Unable to unmarshal package for %s, err=%s\n", userid, err)
-			log.Fatal("Server is stopping\n")
+		// Throttle flooding clients instead of letting them block broadcast.
+		if !instance.Limiter.Allow() {
+			log.Printf("User %s is sending too fast, dropping connection", userid)
+			conn.Close()
+			return
 		}
 
 		msg := Message{}
@@ -119,10 +197,25 @@ func handleConn(conn net.Conn) {
 			userid = packet.Userid
 			instance.Userid = userid
 
+			// A plaintext/TLS LOGIN self-declares its userid, unlike the
+			// SSH transport's key-derived identity, so it's the one place
+			// left that needs an explicit username ban check.
+			if banList.IsBanned(BanName, userid) {
+				log.Printf("rejected login from banned user %s", userid)
+				conn.Close()
+				return
+			}
+
+			// Negotiate the wire codec for the rest of the session. LOGIN
+			// itself is always decoded with JSON, above.
+			if negotiated, ok := codecs[packet.Codec]; ok {
+				instance.Codec = negotiated
+			}
+
 			msg.Userid = userid
 
 			// Start client writer goroutine
-			go clientWriter(rw, ch, userid)
+			go clientWriter(rw, ch, userid, instance.Codec, instance.Session)
 
 			// Check if userid already registered
 			if _, ok := clients[userid]; ok {
@@ -131,7 +224,10 @@ func handleConn(conn net.Conn) {
 				break
 			}
 
+			instance.Room = defaultRoom
+			replayHistory(instance, instance.Room, historyReplaySize)
 			entering <- instance
+			msg.Room = instance.Room
 			msg.Data = fmt.Sprintf("Entered chat (%s)", conn.RemoteAddr().String())
 			broadcast <- msg
 			continue
@@ -139,6 +235,7 @@ func handleConn(conn net.Conn) {
 
 		// Make sure we remember who this is
 		msg.Userid = userid
+		msg.Room = instance.Room
 
 		// When the client terminates trigger cleanup
 		if packet.Action == "QUIT" {
@@ -148,6 +245,40 @@ func handleConn(conn net.Conn) {
 			return
 		}
 
+		// HISTORY lets a client page further back than the replay it got on
+		// LOGIN. packet.Data, if set, is how many messages to fetch.
+		if packet.Action == "HISTORY" {
+			n := historyReplaySize
+			if count, err := strconv.Atoi(packet.Data); err == nil && count > 0 {
+				n = count
+			}
+			replayHistory(instance, instance.Room, n)
+			continue
+		}
+
+		// A message starting with "/" is a slash command rather than chat text.
+		if packet.Action == "MSG" && strings.HasPrefix(packet.Data, "/") {
+			cmd, ok := parseCommand(userid, instance.Room, packet.Data)
+			if !ok {
+				reply(userid, "unknown command")
+				continue
+			}
+			switch cmd.Kind {
+			case CmdNick:
+				cmd.Reply = make(chan string, 1)
+				commands <- cmd
+				userid = <-cmd.Reply
+				instance.Userid = userid
+			case CmdJoin, CmdLeave:
+				cmd.Reply = make(chan string, 1)
+				commands <- cmd
+				instance.Room = <-cmd.Reply
+			default:
+				commands <- cmd
+			}
+			continue
+		}
+
 		// Must be a message so send it out on the broadcast channel
 		msg.Data = packet.Data
 		broadcast <- msg
@@ -158,6 +289,27 @@ func handleConn(conn net.Conn) {
 	close(instance.Channel)
 }
 
+// replayHistory queues the last n stored messages for room onto instance's
+// channel via the same deliverQueue fan-out used for regular broadcasts,
+// ahead of it being added to clients/rooms, so a reconnecting (or newly
+// joined) client can catch up on what it missed without a slow reader
+// blocking its own read loop on a direct, unbounded channel send. n is
+// capped at maxHistoryReplay since HISTORY lets a client pick it directly.
+func replayHistory(instance Instance, room string, n int) {
+	if n > maxHistoryReplay {
+		n = maxHistoryReplay
+	}
+	recent, err := store.Recent(room, n)
+	if err != nil {
+		log.Print("unable to load history for ", room, ": ", err)
+		return
+	}
+	for _, stored := range recent {
+		msg := Message{Userid: stored.Userid, Room: stored.Room, Data: stored.Data}
+		deliverQueue <- deliverJob{Instance: instance, Message: msg}
+	}
+}
+
 // goroutine to broadcast messages to all chat clients. It also monitors entering and
 // leaving channels to maintain the client list
 //
@@ -167,20 +319,49 @@ func broadcaster() {
 		select {
 		case msg := <-broadcast:
 
-			// broadcast to all clients. This goes out on the channel connected to the
-			// clientWriter
-			for _, instance := range clients {
-				instance.Channel <- msg
+			// Admin ban commands are handled here rather than broadcast to
+			// everyone else.
+			if handleBanCommand(msg) {
+				continue
+			}
+
+			// Persist every broadcast message so clients who weren't online
+			// to see it can catch up later via LOGIN replay or HISTORY.
+			if err := store.Append(StoredMessage{Room: msg.Room, Userid: msg.Userid, Data: msg.Data}); err != nil {
+				log.Print("store append failed: ", err)
+			}
+
+			// Hand delivery to every client in the message's room off to the
+			// fan-out worker pool, so one slow client can't stall the rest.
+			for _, instance := range rooms[msg.Room] {
+				deliverQueue <- deliverJob{Instance: instance, Message: msg}
 			}
 
 		// Somebody arrived
 		case instance := <-entering:
 			clients[instance.Userid] = instance
+			if rooms[instance.Room] == nil {
+				rooms[instance.Room] = Room{}
+			}
+			rooms[instance.Room][instance.Userid] = instance
 
-		// Somebody has left
+		// Somebody has left, either on their own or evicted as a slow
+		// consumer. The membership and channel-identity checks make this
+		// safe to process twice, and safe to ignore if a stale leaving
+		// event from a dead connection arrives after its userid has
+		// already reconnected under a new Instance.
 		case instance := <-leaving:
+			current, ok := clients[instance.Userid]
+			if !ok || current.Channel != instance.Channel {
+				continue
+			}
 			delete(clients, instance.Userid)
+			delete(rooms[instance.Room], instance.Userid)
 			close(instance.Channel)
+
+		// A slash command needs to run with exclusive access to clients/rooms
+		case cmd := <-commands:
+			executeCommand(cmd)
 		}
 	}
 }
@@ -188,7 +369,7 @@ func broadcaster() {
 // goroutine to write a message to a specific client. There is one routine per client.
 // This takes messages from the channel and writes them to the client.
 //
-func clientWriter(rw *bufio.ReadWriter, ch <-chan Message, userid string) {
+func clientWriter(rw *bufio.ReadWriter, ch <-chan Message, userid string, codec Codec, session *Session) {
 	log.Printf("clientWriter running.(%s) ...", userid)
 
 	for msg := range ch {
@@ -203,27 +384,22 @@ func clientWriter(rw *bufio.ReadWriter, ch <-chan Message, userid string) {
 		packet.Userid = msg.Userid
 		packet.Data = msg.Data
 		packet.Action = "MSG"
-		writePacketToClient(rw, packet)
+		writePacketToClient(rw, packet, codec, session)
 	}
 	// When the channel is closed, the 'for' loop ends.
 	log.Printf("clientWriter leaving (%s)", userid)
 }
 
-//
-// Write a message packet to chat client. The message is converted into JSON and
-// then sent to the client.
-//
-func writePacketToClient(rw *bufio.ReadWriter, packet Packet) {
+// Write a message packet to a chat client using its negotiated codec, framed
+// with a length prefix and, when session is non-nil, MACed and sequenced
+// against tampering and replay.
+func writePacketToClient(rw *bufio.ReadWriter, packet Packet, codec Codec, session *Session) {
 
-	stream, err := json.Marshal(packet)
-	if err != nil {
-		log.Print("writePacketToClient marshal failed ", err)
+	if err := codec.Encode(rw, packet, session); err != nil {
+		log.Print("writePacketToClient encode failed ", err)
 		return
 	}
-	s := fmt.Sprintf("%s\n", stream)
-	_, err = rw.WriteString(s)
-	rw.Flush()
-	if err != nil {
+	if err := rw.Flush(); err != nil {
 		log.Fatal("writePacketToClient write failed ", err)
 	}
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLeavingIgnoresStaleInstance guards against the broadcaster evicting a
+// reconnected client because of a stale leaving event from its dead
+// predecessor: on a reconnect, the old connection's read loop can notice
+// it's dead only after the new connection has already replaced alice's
+// entry, so the leaving event must only remove the Instance it actually
+// names, not whatever is currently registered under the same userid.
+func TestLeavingIgnoresStaleInstance(t *testing.T) {
+	defer func(saved map[string]Instance) { clients = saved }(clients)
+	defer func(saved map[string]Room) { rooms = saved }(rooms)
+	clients = map[string]Instance{}
+	rooms = map[string]Room{defaultRoom: {}}
+
+	go broadcaster()
+
+	oldChan := make(chan Message, 1)
+	old := Instance{Userid: "alice", Room: defaultRoom, Channel: oldChan}
+	entering <- old
+	time.Sleep(20 * time.Millisecond)
+
+	newChan := make(chan Message, 1)
+	reconnected := Instance{Userid: "alice", Room: defaultRoom, Channel: newChan}
+	entering <- reconnected
+	time.Sleep(20 * time.Millisecond)
+
+	// The old connection's read loop only notices it's dead after the
+	// reconnect has already replaced alice's entry.
+	leaving <- old
+	time.Sleep(20 * time.Millisecond)
+
+	instance, ok := clients["alice"]
+	if !ok {
+		t.Fatal("reconnected alice should still be registered")
+	}
+	if instance.Channel != newChan {
+		t.Fatal("stale leaving event evicted the reconnected client")
+	}
+}
@@ -0,0 +1,52 @@
+// Per-client rate limiting for the chat server. A flooding client should be
+// throttled and eventually kicked instead of being allowed to block the
+// broadcast channel for everyone else.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a simple token-bucket limiter used to guard a single
+// client's read loop. Tokens are refilled lazily whenever Allow is called,
+// so no background goroutine is needed per client.
+type RateLimiter struct {
+	mu         sync.Mutex
+	tokens     float64
+	capacity   float64
+	refillRate float64 // tokens added per second
+	last       time.Time
+}
+
+// NewRateLimiter creates a limiter that allows bursts up to capacity and
+// refills at refillRate tokens per second. It starts full.
+func NewRateLimiter(capacity, refillRate float64) *RateLimiter {
+	return &RateLimiter{
+		tokens:     capacity,
+		capacity:   capacity,
+		refillRate: refillRate,
+		last:       time.Now(),
+	}
+}
+
+// Allow reports whether a packet may be processed now. If so, it consumes
+// one token; otherwise the caller should throttle (and eventually kick) the
+// client.
+func (r *RateLimiter) Allow() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.refillRate
+	if r.tokens > r.capacity {
+		r.tokens = r.capacity
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsBurstUpToCapacity(t *testing.T) {
+	r := NewRateLimiter(3, 1)
+
+	for i := 0; i < 3; i++ {
+		if !r.Allow() {
+			t.Fatalf("call %d: expected Allow to succeed within capacity", i)
+		}
+	}
+	if r.Allow() {
+		t.Fatal("expected Allow to fail once the burst capacity is exhausted")
+	}
+}
+
+func TestRateLimiterRefillsOverTime(t *testing.T) {
+	r := NewRateLimiter(1, 100) // 100 tokens/sec, so a short sleep should refill
+
+	if !r.Allow() {
+		t.Fatal("expected the first call to succeed with a full bucket")
+	}
+	if r.Allow() {
+		t.Fatal("expected the bucket to be empty immediately after")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if !r.Allow() {
+		t.Fatal("expected Allow to succeed again once tokens have refilled")
+	}
+}
@@ -0,0 +1,236 @@
+// SSH transport for the chat server. Unlike the plaintext TCP listener in
+// StartServer, connections here authenticate with an SSH public key, so the
+// Userid comes from the authenticated key fingerprint instead of being
+// self-declared in a LOGIN packet.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// banList is the shared ban list consulted by both transports, keyed by IP,
+// username, and SSH key fingerprint.
+var banList = NewBanList("bans.json")
+
+// admins is the set of userids allowed to run admin commands like !ban.
+var admins = NewAdminSet("admins.json")
+
+// StartSSHServer starts an SSH-based listener as an alternative to the
+// plaintext TCP transport. hostKeyPath is a PEM-encoded private key used to
+// identify this server to connecting clients.
+func StartSSHServer(addr string, hostKeyPath string) {
+
+	initStore()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: authorizeKey,
+	}
+
+	signer, err := loadHostKey(hostKeyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Print("SSH chat server started on ", addr)
+
+	go broadcaster()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		go handleSSHConn(conn, config)
+	}
+}
+
+// loadHostKey reads and parses a PEM private key used as the SSH host key.
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// authorizeKey is the SSH public-key callback. It rejects banned IPs, users,
+// and keys outright, and otherwise accepts the key, recording its
+// fingerprint so the session's identity can be derived from it later.
+func authorizeKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	ip := hostOnly(conn.RemoteAddr().String())
+	if banList.IsBanned(BanIP, ip) {
+		return nil, fmt.Errorf("ip %s is banned", ip)
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	if banList.IsBanned(BanKey, fingerprint) {
+		return nil, fmt.Errorf("key %s is banned", fingerprint)
+	}
+
+	if banList.IsBanned(BanName, conn.User()) {
+		return nil, fmt.Errorf("user %s is banned", conn.User())
+	}
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{"fingerprint": fingerprint},
+	}, nil
+}
+
+// handleSSHConn performs the SSH handshake and then treats the first
+// accepted "chat" channel as the chat stream, handing it off to the same
+// Packet-based protocol used by the plaintext transport. The channel type
+// is deliberately not "session": this isn't a general-purpose interactive
+// SSH server, so it never negotiates a pty or shell, and a custom channel
+// type keeps a real OpenSSH client from attempting to open one expecting a
+// terminal. imclient.go's "ssh" transport is the client that speaks it.
+func handleSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Print("SSH handshake failed: ", err)
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	fingerprint := sshConn.Permissions.Extensions["fingerprint"]
+	userid := sshConn.User() + ":" + fingerprint[:12]
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "chat" {
+			newChannel.Reject(ssh.UnknownChannelType, "only chat channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Print("SSH channel accept failed: ", err)
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+
+		handleAuthenticatedStream(channel, conn, userid)
+		return
+	}
+}
+
+// handleAuthenticatedStream runs the same LOGIN-less protocol loop as
+// handleConn, except the Userid is already known from the SSH key and is
+// never trusted from the packet itself.
+func handleAuthenticatedStream(stream io.ReadWriter, conn net.Conn, userid string) {
+
+	log.Print("Handling SSH connection for ", userid)
+
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+
+	instance := Instance{Userid: userid, Connect: conn, RW: rw, Room: defaultRoom}
+	instance.Limiter = NewRateLimiter(20, 5)
+	instance.Codec = codecs[CodecJSON]
+	ch := make(chan Message, clientQueueSize)
+	instance.Channel = ch
+
+	go clientWriter(rw, ch, userid, instance.Codec, nil)
+	replayHistory(instance, instance.Room, historyReplaySize)
+	entering <- instance
+	broadcast <- Message{Userid: userid, Room: defaultRoom, Data: fmt.Sprintf("Entered chat (%s)", conn.RemoteAddr().String()), Clinst: instance}
+
+	for {
+		packet, err := instance.Codec.Decode(rw, nil)
+		if err != nil {
+			log.Print(err)
+			break
+		}
+
+		if !instance.Limiter.Allow() {
+			log.Printf("User %s is sending too fast, dropping connection", userid)
+			break
+		}
+
+		if negotiated, ok := codecs[packet.Codec]; ok {
+			instance.Codec = negotiated
+		}
+
+		msg := Message{Userid: userid, Room: instance.Room, Clinst: instance}
+
+		if packet.Action == "QUIT" {
+			msg.Data = "Left chat"
+			broadcast <- msg
+			leaving <- instance
+			conn.Close()
+			return
+		}
+
+		// Ignore any client-declared Userid: identity comes from the SSH key.
+		msg.Data = packet.Data
+		broadcast <- msg
+	}
+
+	leaving <- instance
+	conn.Close()
+}
+
+// hostOnly strips the port from a net.Addr-formatted string.
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// handleBanCommand inspects a broadcaster message for the admin
+// "!ban <ip|name|key> <value> <duration>" syntax and, if matched and the
+// sender is in admins, applies the ban instead of letting the message go
+// out to every client. It reports whether the message was consumed as a
+// ban command (so a non-admin typing "!ban ..." also doesn't get it
+// broadcast verbatim).
+func handleBanCommand(msg Message) bool {
+	if !strings.HasPrefix(msg.Data, "!ban ") {
+		return false
+	}
+
+	if !admins.IsAdmin(msg.Userid) {
+		log.Printf("rejected !ban from non-admin %s", msg.Userid)
+		reply(msg.Userid, "!ban: permission denied")
+		return true
+	}
+
+	fields := strings.Fields(msg.Data)
+	if len(fields) != 4 {
+		log.Printf("malformed !ban command from %s: %q", msg.Userid, msg.Data)
+		return true
+	}
+
+	kind := BanKind(fields[1])
+	switch kind {
+	case BanIP, BanName, BanKey:
+	default:
+		log.Printf("unknown ban kind %q from %s", fields[1], msg.Userid)
+		return true
+	}
+
+	duration, err := time.ParseDuration(fields[3])
+	if err != nil {
+		log.Printf("invalid ban duration %q from %s: %s", fields[3], msg.Userid, err)
+		return true
+	}
+
+	banList.Ban(kind, fields[2], duration)
+	log.Printf("%s banned %s %s for %s", msg.Userid, kind, fields[2], duration)
+	return true
+}
@@ -0,0 +1,153 @@
+// Message history and persistence. Broadcast messages used to be
+// fire-and-forget: a client that wasn't online to see a message never got
+// it. Store lets the broadcaster persist every message and replay recent
+// history to a client on LOGIN (and on demand via a HISTORY packet) so
+// users don't all have to be online at once.
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// historyReplaySize is how many recent messages are replayed to a client
+// when they LOGIN, absent an explicit count on a HISTORY packet.
+const historyReplaySize = 20
+
+// maxHistoryReplay caps how many messages a client-requested HISTORY
+// packet can pull back at once, since n otherwise comes straight from the
+// client with no upper bound.
+const maxHistoryReplay = 500
+
+// StoredMessage is one persisted chat line.
+type StoredMessage struct {
+	Room   string
+	Userid string
+	Data   string
+}
+
+// Store persists chat messages per room.
+type Store interface {
+	Append(msg StoredMessage) error
+	Recent(room string, n int) ([]StoredMessage, error)
+}
+
+// store is the server's persistence backend, set up by initStore.
+var store Store
+
+// initStore opens the default SQLite-backed store, falling back to an
+// in-memory ring if that fails (e.g. no writable disk), so the server can
+// still run with best-effort history. Safe to call more than once.
+func initStore() {
+	if store != nil {
+		return
+	}
+	s, err := NewSQLiteStore("chat_history.db")
+	if err != nil {
+		log.Print("unable to open sqlite store, falling back to in-memory: ", err)
+		s = NewRingStore(200)
+	}
+	store = s
+}
+
+// ringStore is an in-memory Store backed by a fixed-size ring per room. It's
+// also handy for tests, where a SQLite file on disk isn't wanted.
+type ringStore struct {
+	mu       sync.Mutex
+	capacity int
+	rooms    map[string][]StoredMessage
+}
+
+// NewRingStore returns a Store that keeps only the most recent capacity
+// messages per room, in memory.
+func NewRingStore(capacity int) Store {
+	return &ringStore{capacity: capacity, rooms: make(map[string][]StoredMessage)}
+}
+
+func (s *ringStore) Append(msg StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := append(s.rooms[msg.Room], msg)
+	if len(history) > s.capacity {
+		history = history[len(history)-s.capacity:]
+	}
+	s.rooms[msg.Room] = history
+	return nil
+}
+
+func (s *ringStore) Recent(room string, n int) ([]StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := s.rooms[room]
+	if n > len(history) {
+		n = len(history)
+	}
+	out := make([]StoredMessage, n)
+	copy(out, history[len(history)-n:])
+	return out, nil
+}
+
+// sqliteStore is a Store backed by a SQLite database.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens (creating if necessary) a SQLite database at path
+// and ensures its schema exists.
+func NewSQLiteStore(path string) (Store, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	const schema = `CREATE TABLE IF NOT EXISTS messages (
+		id     INTEGER PRIMARY KEY AUTOINCREMENT,
+		room   TEXT NOT NULL,
+		userid TEXT NOT NULL,
+		data   TEXT NOT NULL
+	)`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Append(msg StoredMessage) error {
+	_, err := s.db.Exec(`INSERT INTO messages (room, userid, data) VALUES (?, ?, ?)`,
+		msg.Room, msg.Userid, msg.Data)
+	return err
+}
+
+func (s *sqliteStore) Recent(room string, n int) ([]StoredMessage, error) {
+	rows, err := s.db.Query(
+		`SELECT userid, data FROM messages WHERE room = ? ORDER BY id DESC LIMIT ?`, room, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []StoredMessage
+	for rows.Next() {
+		msg := StoredMessage{Room: room}
+		if err := rows.Scan(&msg.Userid, &msg.Data); err != nil {
+			return nil, err
+		}
+		out = append(out, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Oldest first, to match the order messages were actually sent in.
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
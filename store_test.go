@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestRingStoreAppendAndRecent(t *testing.T) {
+	s := NewRingStore(10)
+
+	for _, data := range []string{"one", "two", "three"} {
+		if err := s.Append(StoredMessage{Room: "general", Userid: "alice", Data: data}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	recent, err := s.Recent("general", 2)
+	if err != nil {
+		t.Fatalf("Recent failed: %v", err)
+	}
+	if len(recent) != 2 {
+		t.Fatalf("Recent returned %d messages, want 2", len(recent))
+	}
+	if recent[0].Data != "two" || recent[1].Data != "three" {
+		t.Fatalf("Recent = %+v, want the last 2 messages in order", recent)
+	}
+}
+
+func TestRingStoreEvictsBeyondCapacity(t *testing.T) {
+	s := NewRingStore(2)
+
+	for _, data := range []string{"one", "two", "three"} {
+		if err := s.Append(StoredMessage{Room: "general", Data: data}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	recent, err := s.Recent("general", 10)
+	if err != nil {
+		t.Fatalf("Recent failed: %v", err)
+	}
+	if len(recent) != 2 {
+		t.Fatalf("Recent returned %d messages, want capacity-bound 2", len(recent))
+	}
+	if recent[0].Data != "two" || recent[1].Data != "three" {
+		t.Fatalf("Recent = %+v, want the oldest message evicted", recent)
+	}
+}
+
+func TestRingStoreKeepsRoomsSeparate(t *testing.T) {
+	s := NewRingStore(10)
+	s.Append(StoredMessage{Room: "a", Data: "hi"})
+	s.Append(StoredMessage{Room: "b", Data: "there"})
+
+	recent, err := s.Recent("a", 10)
+	if err != nil {
+		t.Fatalf("Recent failed: %v", err)
+	}
+	if len(recent) != 1 || recent[0].Data != "hi" {
+		t.Fatalf("Recent(%q) = %+v, want only that room's messages", "a", recent)
+	}
+}